@@ -4,8 +4,43 @@
 // Package fslock provides a cross-process mutex based on file locks.
 //
 // It is built on top of flock for linux and darwin, and LockFileEx on Windows.
+//
+// Both exclusive and shared (read) locks are supported: Lock/Unlock take the
+// exclusive lock, while RLock/RUnlock take a shared lock that may be held by
+// multiple readers at once as long as no writer holds the exclusive lock.
+//
+// OS-level file locks (flock and LockFileEx) are advisory per-file-description
+// or per-handle, which means two Lock values in the same process that both
+// refer to the same path can fail to exclude each other. To make a Lock safe
+// to share across goroutines in a single process, every Lock acquired for a
+// given path also takes a process-wide sync.RWMutex for that path before
+// touching the OS lock, and releases it afterwards.
+//
+// Every successful exclusive Lock writes a small JSON record of who's
+// holding the lock (pid, hostname, acquire time, and an optional caller
+// comment) into a sidecar file next to the lock file, so that Owner can
+// report it for diagnosing stuck processes; see OwnerInfo.
 package fslock
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RetryDelay is how long LockWithTimeout, RLockWithTimeout, LockContext
+// and RLockContext wait between non-blocking acquisition attempts while
+// polling for the lock. It is a package variable, rather than a
+// per-Lock setting, so that it can be tuned once for a process (e.g. to
+// poll faster in tests); the default matches this package's historical
+// polling interval.
+var RetryDelay = 50 * time.Millisecond
+
 // ErrTimeout indicates that the lock attempt timed out.
 var ErrTimeout error = timeoutError("lock timeout exceeded")
 
@@ -17,3 +52,151 @@ func (t timeoutError) Error() string {
 func (timeoutError) Timeout() bool {
 	return true
 }
+
+// OwnerInfo describes who holds (or last held) the exclusive lock on a
+// file. It is recorded by every successful exclusive Lock and can be
+// retrieved without acquiring the lock via Lock.Owner.
+type OwnerInfo struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Acquired time.Time `json:"acquired"`
+	Comment  string    `json:"comment,omitempty"`
+}
+
+// ErrNoOwner is returned by Lock.Owner when the lock is not currently held.
+var ErrNoOwner = errors.New("fslock: lock is not held")
+
+// Owner reports who currently holds the exclusive lock, without acquiring
+// it itself. It returns ErrNoOwner if the lock is not currently held.
+func (l Lock) Owner() (OwnerInfo, error) {
+	return readOwnerInfo(l.path)
+}
+
+// ownerSidecarPath returns the path of the file used to record the owner
+// of the lock on path. A sidecar is used, rather than the lock file
+// itself, so that recording the owner doesn't clobber the contents of
+// files locked through LockedFile.
+func ownerSidecarPath(path string) string {
+	return path + ".owner"
+}
+
+// writeOwnerInfo replaces the owner sidecar file for path with a JSON
+// OwnerInfo payload describing the current process as the holder. The
+// sidecar is written to a temporary file and renamed into place so that a
+// concurrent Owner() or newTimeoutError lookup never observes a
+// truncated or partially written file. Errors are not fatal to the
+// caller: this is a best-effort diagnostic aid, not a correctness
+// guarantee.
+func writeOwnerInfo(path, comment string) {
+	info := OwnerInfo{
+		PID:      os.Getpid(),
+		Hostname: ownerHostname(),
+		Acquired: time.Now(),
+		Comment:  comment,
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+	sidecar := ownerSidecarPath(path)
+	tmp := sidecar + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	os.Rename(tmp, sidecar)
+}
+
+// clearOwnerInfo removes the owner sidecar file written by writeOwnerInfo.
+func clearOwnerInfo(path string) {
+	os.Remove(ownerSidecarPath(path))
+}
+
+// readOwnerInfo reads and parses the JSON OwnerInfo payload recorded for
+// path, without acquiring the lock.
+func readOwnerInfo(path string) (OwnerInfo, error) {
+	data, err := ioutil.ReadFile(ownerSidecarPath(path))
+	if os.IsNotExist(err) {
+		return OwnerInfo{}, ErrNoOwner
+	} else if err != nil {
+		return OwnerInfo{}, err
+	}
+	var info OwnerInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return OwnerInfo{}, err
+	}
+	return info, nil
+}
+
+func ownerHostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// lockTimeoutError is returned by LockWithTimeout and RLockWithTimeout when
+// the timeout expires. It carries the same message and Timeout() semantics
+// as ErrTimeout, and satisfies errors.Is(err, ErrTimeout), but additionally
+// names the current owner of the lock when one can be determined.
+type lockTimeoutError struct {
+	owner    OwnerInfo
+	hasOwner bool
+}
+
+// newTimeoutError builds the error returned when acquiring the lock on
+// path times out, annotated with the lock's current owner if known.
+func newTimeoutError(path string) error {
+	owner, err := readOwnerInfo(path)
+	return &lockTimeoutError{owner: owner, hasOwner: err == nil}
+}
+
+func (e *lockTimeoutError) Error() string {
+	if !e.hasOwner {
+		return ErrTimeout.Error()
+	}
+	if e.owner.Comment == "" {
+		return fmt.Sprintf("%s (held by pid %d on %s since %s)",
+			ErrTimeout.Error(), e.owner.PID, e.owner.Hostname, e.owner.Acquired.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s (held by pid %d on %s since %s: %s)",
+		ErrTimeout.Error(), e.owner.PID, e.owner.Hostname, e.owner.Acquired.Format(time.RFC3339), e.owner.Comment)
+}
+
+func (e *lockTimeoutError) Timeout() bool { return true }
+
+func (e *lockTimeoutError) Is(target error) bool { return target == ErrTimeout }
+
+var (
+	inProcMu    sync.Mutex
+	inProcLocks = make(map[string]*sync.RWMutex)
+)
+
+// canonicalPath returns the absolute form of path, falling back to path
+// itself if it can't be resolved. New and NewWithOwner store this in
+// Lock.path, rather than the raw filename, so that the owner sidecar
+// (see ownerSidecarPath) and the in-process mutex (inProcessMutex) agree
+// on identity for two Locks opened with different spellings of the same
+// file (e.g. relative vs absolute).
+func canonicalPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+// inProcessMutex returns the process-wide mutex guarding path, creating one
+// if this is the first Lock seen for it. path must already be canonicalized
+// via canonicalPath so that different spellings of the same file share a
+// mutex.
+func inProcessMutex(path string) *sync.RWMutex {
+	inProcMu.Lock()
+	defer inProcMu.Unlock()
+	mu, ok := inProcLocks[path]
+	if !ok {
+		mu = new(sync.RWMutex)
+		inProcLocks[path] = mu
+	}
+	return mu
+}
@@ -0,0 +1,132 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// LockedFile is an *os.File whose contents are protected by a Lock for as
+// long as the LockedFile is open. It gives callers a race-free way to read
+// or read-modify-write a shared file without hand-rolling their own
+// lock-then-open dance.
+type LockedFile struct {
+	*os.File
+
+	lock   Lock
+	shared bool
+}
+
+// OpenLocked opens the named file as os.OpenFile would, but holds the
+// exclusive lock on it before any of its data is touched: os.O_TRUNC is
+// applied only once the lock is held. Unlike os.OpenFile, the file is
+// created if it does not exist even when flag lacks os.O_CREATE. The lock
+// is held until the returned LockedFile's Close method is called.
+func OpenLocked(path string, flag int, perm os.FileMode) (*LockedFile, error) {
+	return openLocked(path, flag, perm, false)
+}
+
+// openLocked is the shared implementation behind OpenLocked and the
+// package-level Read/Write/Transform helpers. It locks path and opens it
+// for data I/O through openFileAndLock, whose per-platform implementation
+// decides whether that needs one handle or two (see its doc). os.O_TRUNC
+// is held back from the open and applied after the lock is acquired, so
+// that a concurrent holder of the lock never sees the file emptied.
+func openLocked(path string, flag int, perm os.FileMode, shared bool) (*LockedFile, error) {
+	f, lock, err := openFileAndLock(path, flag&^os.O_TRUNC, perm, "", shared)
+	if err != nil {
+		return nil, err
+	}
+	lf := &LockedFile{File: f, lock: lock, shared: shared}
+	if flag&os.O_TRUNC != 0 {
+		if err := f.Truncate(0); err != nil {
+			lf.Close()
+			return nil, err
+		}
+	}
+	return lf, nil
+}
+
+// Close releases the lock and closes the underlying file, in that order.
+// The lock is released first because, on unix and Windows,
+// openFileAndLock makes the Lock share the file's own fd/handle, so
+// releasing it after the fd is closed
+// would operate on an already-closed (or worse, reused) descriptor.
+func (f *LockedFile) Close() error {
+	unlockErr := unlock(f.lock, f.shared)
+	closeErr := f.File.Close()
+	if unlockErr != nil {
+		return unlockErr
+	}
+	return closeErr
+}
+
+func unlock(lock Lock, shared bool) error {
+	if shared {
+		return lock.RUnlock()
+	}
+	return lock.Unlock()
+}
+
+// Read returns the contents of the file at path, holding the shared lock
+// for the duration of the read so that it cannot observe a concurrent
+// partial write made through Write or Transform.
+func Read(path string) ([]byte, error) {
+	f, err := openLocked(path, os.O_RDONLY, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f.File)
+}
+
+// Write replaces the contents of the file at path with content, holding
+// the exclusive lock for the duration of the write.
+func Write(path string, content io.Reader, perm os.FileMode) error {
+	f, err := openLocked(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm, false)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f.File, content)
+	return err
+}
+
+// Transform performs a race-free read-modify-write of the file at path: it
+// acquires the exclusive lock, reads the current contents, passes them to
+// t, and replaces the file with the result by writing back through the
+// same locked handle, all while still holding the lock.
+//
+// This deliberately does not rename a replacement file into place: New
+// binds the lock to path's current inode/handle, so a rename would leave
+// a concurrent caller free to lock the new inode it creates without any
+// exclusion from this call — see cmd/go/internal/lockedfile.Transform,
+// which takes the same approach for the same reason.
+func Transform(path string, t func(old []byte) (new []byte, err error)) error {
+	f, err := openLocked(path, os.O_RDWR|os.O_CREATE, 0600, false)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	old, err := ioutil.ReadAll(f.File)
+	if err != nil {
+		return err
+	}
+	content, err := t(old)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	return err
+}
@@ -6,51 +6,219 @@
 package fslock
 
 import (
+	"context"
+	"os"
+	"sync"
 	"syscall"
 	"time"
 )
 
 // Lock implements cross-process locks using syscalls.
 // This implementation is based on flock syscall.
-type Lock int
+type Lock struct {
+	fd int
+	// mu guards against two Locks in this process that refer to the same
+	// path deadlocking or double-unlocking each other; see the package doc.
+	mu *sync.RWMutex
+	// path and comment support the owner diagnostics written by Lock; see
+	// the package doc and OwnerInfo.
+	path    string
+	comment string
+}
 
 // New returns a new lock around the given file.
 func New(filename string) (Lock, error) {
+	return NewWithOwner(filename, OwnerInfo{})
+}
+
+// NewWithOwner returns a new lock around the given file, recording
+// info.Comment alongside the process's pid, hostname and acquire time
+// every time the exclusive lock is acquired. The other fields of info are
+// ignored, since they are always recomputed at acquisition time.
+func NewWithOwner(filename string, info OwnerInfo) (Lock, error) {
 	fd, err := syscall.Open(filename, syscall.O_CREAT|syscall.O_RDONLY, 0600)
 	if err != nil {
-		return 0, err
+		return Lock{}, err
 	}
-	return Lock(fd), nil
+	path := canonicalPath(filename)
+	return Lock{fd: fd, mu: inProcessMutex(path), path: path, comment: info.Comment}, nil
+}
+
+// openFileAndLock opens path and locks it in one step, so that the
+// returned *os.File and Lock share a single fd. flock is advisory, so the
+// data could just as well be read and written through a second fd, but
+// sharing the fd keeps this function's shape identical across platforms;
+// see LockedFile in
+// fslock_file.go, which is built on top of this.
+func openFileAndLock(path string, flag int, perm os.FileMode, comment string, shared bool) (*os.File, Lock, error) {
+	if perm == 0 {
+		perm = 0600
+	}
+	f, err := os.OpenFile(path, flag|os.O_CREATE, perm)
+	if err != nil {
+		return nil, Lock{}, err
+	}
+	cpath := canonicalPath(path)
+	lock := Lock{fd: int(f.Fd()), mu: inProcessMutex(cpath), path: cpath, comment: comment}
+	if shared {
+		err = lock.RLock()
+	} else {
+		err = lock.Lock()
+	}
+	if err != nil {
+		f.Close()
+		return nil, Lock{}, err
+	}
+	return f, lock, nil
 }
 
 // Lock locks the lock.  This call will block until the lock is available.
 func (l Lock) Lock() error {
-	return syscall.Flock(int(l), syscall.LOCK_EX)
+	l.mu.Lock()
+	if err := syscall.Flock(l.fd, syscall.LOCK_EX); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	writeOwnerInfo(l.path, l.comment)
+	return nil
 }
 
 // Unlock unlocks the lock.
 func (l Lock) Unlock() error {
-	return syscall.Flock(int(l), syscall.LOCK_UN)
+	clearOwnerInfo(l.path)
+	err := syscall.Flock(l.fd, syscall.LOCK_UN)
+	l.mu.Unlock()
+	return err
 }
 
 // LockWithTimeout tries to lock the lock until the timeout expires.
 func (l Lock) LockWithTimeout(timeout time.Duration) error {
+	return l.lockWithTimeout(syscall.LOCK_EX, timeout)
+}
+
+// RLock locks the lock for shared (read-only) access. This call will block
+// until the lock is available. Multiple holders of the shared lock may
+// coexist, but they exclude any holder of the exclusive lock obtained via
+// Lock.
+func (l Lock) RLock() error {
+	l.mu.RLock()
+	if err := syscall.Flock(l.fd, syscall.LOCK_SH); err != nil {
+		l.mu.RUnlock()
+		return err
+	}
+	return nil
+}
+
+// RUnlock unlocks a lock previously acquired with RLock.
+func (l Lock) RUnlock() error {
+	err := syscall.Flock(l.fd, syscall.LOCK_UN)
+	l.mu.RUnlock()
+	return err
+}
+
+// RLockWithTimeout tries to acquire the shared lock until the timeout
+// expires.
+func (l Lock) RLockWithTimeout(timeout time.Duration) error {
+	return l.lockWithTimeout(syscall.LOCK_SH, timeout)
+}
+
+// TryLock makes a single non-blocking attempt to acquire the exclusive
+// lock, reporting whether it succeeded.
+func (l Lock) TryLock() (bool, error) {
+	return l.tryAcquire(syscall.LOCK_EX)
+}
+
+// TryRLock makes a single non-blocking attempt to acquire the shared lock,
+// reporting whether it succeeded.
+func (l Lock) TryRLock() (bool, error) {
+	return l.tryAcquire(syscall.LOCK_SH)
+}
+
+// lockWithTimeout repeatedly makes non-blocking acquisition attempts with
+// the given mode until one succeeds or the timeout expires.
+func (l Lock) lockWithTimeout(how int, timeout time.Duration) error {
 	var t time.Time
 	for {
 		if t.IsZero() {
 			t = time.Now()
 		} else if timeout > 0 && time.Since(t) > timeout {
-			return ErrTimeout
+			return newTimeoutError(l.path)
 		}
 
-		err := syscall.Flock(int(l), syscall.LOCK_EX|syscall.LOCK_NB)
-		if err == nil {
-			return nil
-		} else if err != syscall.EWOULDBLOCK {
+		ok, err := l.tryAcquire(how)
+		if err != nil {
 			return err
+		} else if ok {
+			return nil
 		}
 
 		// Wait for a bit and try again.
-		time.Sleep(50 * time.Millisecond)
+		time.Sleep(RetryDelay)
+	}
+}
+
+// LockContext locks the lock, blocking until it is acquired or ctx is
+// cancelled or its deadline expires.
+func (l Lock) LockContext(ctx context.Context) error {
+	return l.lockContext(syscall.LOCK_EX, ctx)
+}
+
+// RLockContext acquires the shared lock, blocking until it is acquired or
+// ctx is cancelled or its deadline expires.
+func (l Lock) RLockContext(ctx context.Context) error {
+	return l.lockContext(syscall.LOCK_SH, ctx)
+}
+
+// lockContext repeatedly makes non-blocking acquisition attempts with the
+// given mode, waiting RetryDelay between attempts, until one succeeds or
+// ctx is done.
+func (l Lock) lockContext(how int, ctx context.Context) error {
+	for {
+		ok, err := l.tryAcquire(how)
+		if err != nil {
+			return err
+		} else if ok {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(RetryDelay):
+		}
+	}
+}
+
+// tryAcquire makes a single non-blocking attempt to take both the
+// in-process mutex and the flock for the given mode, reporting whether it
+// succeeded. If the flock attempt fails, the in-process mutex is released
+// again so this is safe to call repeatedly.
+func (l Lock) tryAcquire(how int) (bool, error) {
+	var gotMu bool
+	if how == syscall.LOCK_EX {
+		gotMu = l.mu.TryLock()
+	} else {
+		gotMu = l.mu.TryRLock()
+	}
+	if !gotMu {
+		return false, nil
+	}
+
+	err := syscall.Flock(l.fd, how|syscall.LOCK_NB)
+	if err == nil {
+		if how == syscall.LOCK_EX {
+			writeOwnerInfo(l.path, l.comment)
+		}
+		return true, nil
+	}
+
+	if how == syscall.LOCK_EX {
+		l.mu.Unlock()
+	} else {
+		l.mu.RUnlock()
+	}
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
 	}
+	return false, err
 }
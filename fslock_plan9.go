@@ -0,0 +1,256 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lock implements cross-process locks for Plan 9, which has no advisory
+// file locking syscall. Instead, acquiring the lock is modelled as
+// exclusively creating a companion "<path>.lock" file, the same approach
+// Go's own lockedfile_plan9.go takes; releasing the lock removes it.
+//
+// Plan 9 has no primitive for a true shared lock either, so RLock and
+// RUnlock behave the same as Lock and Unlock here: only one reader or
+// writer may hold the lock at a time.
+type Lock struct {
+	path     string
+	lockPath string
+	comment  string
+	// mu guards against two Locks in this process that refer to the same
+	// path deadlocking or double-unlocking each other; see the package doc.
+	mu *sync.RWMutex
+}
+
+// New returns a new lock around the given file.
+func New(filename string) (Lock, error) {
+	return NewWithOwner(filename, OwnerInfo{})
+}
+
+// NewWithOwner returns a new lock around the given file, recording
+// info.Comment alongside the process's pid, hostname and acquire time
+// every time the lock is acquired. The other fields of info are ignored,
+// since they are always recomputed at acquisition time.
+func NewWithOwner(filename string, info OwnerInfo) (Lock, error) {
+	// Create filename itself if it doesn't already exist, to match the
+	// nix/windows implementations, where opening the lock file has this
+	// side effect. This keeps e.g. Read on a never-written path behaving
+	// the same on every platform.
+	f, err := os.OpenFile(filename, os.O_CREATE, 0600)
+	if err != nil {
+		return Lock{}, err
+	}
+	f.Close()
+
+	path := canonicalPath(filename)
+	return Lock{
+		path:     path,
+		lockPath: path + ".lock",
+		comment:  info.Comment,
+		mu:       inProcessMutex(path),
+	}, nil
+}
+
+// openFileAndLock opens path and locks it, returning both. Unlike the
+// unix/Windows backends, Plan 9's lock is a companion file rather than a
+// lock on path's own handle, so there is no handle to share between the
+// two here; the lock is acquired first and path is then opened for data
+// I/O.
+func openFileAndLock(path string, flag int, perm os.FileMode, comment string, shared bool) (*os.File, Lock, error) {
+	lock, err := NewWithOwner(path, OwnerInfo{Comment: comment})
+	if err != nil {
+		return nil, Lock{}, err
+	}
+	if shared {
+		err = lock.RLock()
+	} else {
+		err = lock.Lock()
+	}
+	if err != nil {
+		return nil, Lock{}, err
+	}
+	f, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		unlock(lock, shared)
+		return nil, Lock{}, err
+	}
+	return f, lock, nil
+}
+
+// Lock locks the lock.  This call will block until the lock is available.
+func (l Lock) Lock() error {
+	l.mu.Lock()
+	if err := l.acquire(); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	writeOwnerInfo(l.path, l.comment)
+	return nil
+}
+
+// Unlock unlocks the lock.
+func (l Lock) Unlock() error {
+	clearOwnerInfo(l.path)
+	err := os.Remove(l.lockPath)
+	l.mu.Unlock()
+	return err
+}
+
+// RLock locks the lock. Plan 9 has no shared-lock primitive, so this is
+// equivalent to Lock.
+func (l Lock) RLock() error {
+	l.mu.RLock()
+	if err := l.acquire(); err != nil {
+		l.mu.RUnlock()
+		return err
+	}
+	return nil
+}
+
+// RUnlock unlocks a lock previously acquired with RLock.
+func (l Lock) RUnlock() error {
+	err := os.Remove(l.lockPath)
+	l.mu.RUnlock()
+	return err
+}
+
+// LockWithTimeout tries to lock the lock until the timeout expires.
+func (l Lock) LockWithTimeout(timeout time.Duration) error {
+	return l.lockWithTimeout(true, timeout)
+}
+
+// RLockWithTimeout tries to acquire the lock until the timeout expires.
+// See RLock for why this is equivalent to LockWithTimeout on Plan 9.
+func (l Lock) RLockWithTimeout(timeout time.Duration) error {
+	return l.lockWithTimeout(false, timeout)
+}
+
+// TryLock makes a single non-blocking attempt to acquire the lock,
+// reporting whether it succeeded.
+func (l Lock) TryLock() (bool, error) {
+	return l.tryAcquire(true)
+}
+
+// TryRLock makes a single non-blocking attempt to acquire the lock,
+// reporting whether it succeeded. See RLock for why this is equivalent to
+// TryLock on Plan 9.
+func (l Lock) TryRLock() (bool, error) {
+	return l.tryAcquire(false)
+}
+
+// LockContext locks the lock, blocking until it is acquired or ctx is
+// cancelled or its deadline expires.
+func (l Lock) LockContext(ctx context.Context) error {
+	return l.lockContext(true, ctx)
+}
+
+// RLockContext acquires the lock, blocking until it is acquired or ctx is
+// cancelled or its deadline expires. See RLock for why this is equivalent
+// to LockContext on Plan 9.
+func (l Lock) RLockContext(ctx context.Context) error {
+	return l.lockContext(false, ctx)
+}
+
+// lockWithTimeout repeatedly attempts to acquire the lock until it
+// succeeds or the timeout expires.
+func (l Lock) lockWithTimeout(exclusive bool, timeout time.Duration) error {
+	var t time.Time
+	for {
+		if t.IsZero() {
+			t = time.Now()
+		} else if timeout > 0 && time.Since(t) > timeout {
+			return newTimeoutError(l.path)
+		}
+
+		ok, err := l.tryAcquire(exclusive)
+		if err != nil {
+			return err
+		} else if ok {
+			return nil
+		}
+
+		time.Sleep(RetryDelay)
+	}
+}
+
+// lockContext repeatedly attempts to acquire the lock, waiting RetryDelay
+// between attempts, until it succeeds or ctx is done.
+func (l Lock) lockContext(exclusive bool, ctx context.Context) error {
+	for {
+		ok, err := l.tryAcquire(exclusive)
+		if err != nil {
+			return err
+		} else if ok {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(RetryDelay):
+		}
+	}
+}
+
+// tryAcquire makes a single non-blocking attempt to take both the
+// in-process mutex and the companion lock file, reporting whether it
+// succeeded. If the file create fails because it already exists, the
+// in-process mutex is released again so this is safe to call repeatedly.
+func (l Lock) tryAcquire(exclusive bool) (bool, error) {
+	var gotMu bool
+	if exclusive {
+		gotMu = l.mu.TryLock()
+	} else {
+		gotMu = l.mu.TryRLock()
+	}
+	if !gotMu {
+		return false, nil
+	}
+
+	err := l.create()
+	if err == nil {
+		if exclusive {
+			writeOwnerInfo(l.path, l.comment)
+		}
+		return true, nil
+	}
+
+	if exclusive {
+		l.mu.Unlock()
+	} else {
+		l.mu.RUnlock()
+	}
+	if os.IsExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// acquire blocks until the companion lock file can be exclusively created.
+func (l Lock) acquire() error {
+	for {
+		err := l.create()
+		if err == nil {
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		time.Sleep(RetryDelay)
+	}
+}
+
+// create exclusively creates the companion lock file, the Plan 9 stand-in
+// for taking an advisory OS-level lock.
+func (l Lock) create() error {
+	f, err := os.OpenFile(l.lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -4,10 +4,14 @@
 package fslock_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	stdtesting "testing"
@@ -101,7 +105,244 @@ func (s *fslockSuite) TestLockWithTimeoutLocked(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 
 	err = lock2.LockWithTimeout(shortWait)
-	c.Assert(err, gc.Equals, fslock.ErrTimeout)
+	c.Assert(errors.Is(err, fslock.ErrTimeout), gc.Equals, true)
+}
+
+func (s *fslockSuite) TestRLockAllowsMultipleReaders(c *gc.C) {
+	dir := c.MkDir()
+	lock1, err := fslock.New(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+	lock2, err := fslock.New(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+
+	err = lock1.RLock()
+	c.Assert(err, gc.IsNil)
+	defer lock1.RUnlock()
+
+	err = lock2.RLockWithTimeout(shortWait)
+	c.Assert(err, gc.IsNil)
+	defer lock2.RUnlock()
+}
+
+func (s *fslockSuite) TestRLockBlocksWriter(c *gc.C) {
+	dir := c.MkDir()
+	lock1, err := fslock.New(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+	lock2, err := fslock.New(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+
+	err = lock1.RLock()
+	c.Assert(err, gc.IsNil)
+
+	err = lock2.LockWithTimeout(shortWait)
+	c.Assert(errors.Is(err, fslock.ErrTimeout), gc.Equals, true)
+
+	err = lock1.RUnlock()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *fslockSuite) TestTryLock(c *gc.C) {
+	dir := c.MkDir()
+	lock1, err := fslock.New(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+	lock2, err := fslock.New(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+
+	ok, err := lock1.TryLock()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+
+	ok, err = lock2.TryRLock()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+
+	err = lock1.Unlock()
+	c.Assert(err, gc.IsNil)
+
+	ok, err = lock2.TryRLock()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+}
+
+func (s *fslockSuite) TestLockContextUnlocked(c *gc.C) {
+	dir := c.MkDir()
+	lock, err := fslock.New(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), longWait)
+	defer cancel()
+	err = lock.LockContext(ctx)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *fslockSuite) TestLockContextCancelled(c *gc.C) {
+	dir := c.MkDir()
+	lock1, err := fslock.New(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+	lock2, err := fslock.New(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+
+	err = lock1.Lock()
+	c.Assert(err, gc.IsNil)
+	defer lock1.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortWait)
+	defer cancel()
+	err = lock2.LockContext(ctx)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+}
+
+func (s *fslockSuite) TestRetryDelayIsConfigurable(c *gc.C) {
+	old := fslock.RetryDelay
+	fslock.RetryDelay = time.Millisecond
+	defer func() { fslock.RetryDelay = old }()
+
+	dir := c.MkDir()
+	lock1, err := fslock.New(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+	lock2, err := fslock.New(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+
+	err = lock1.Lock()
+	c.Assert(err, gc.IsNil)
+
+	unlocked := make(chan struct{})
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		lock1.Unlock()
+		close(unlocked)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), longWait)
+	defer cancel()
+	err = lock2.LockContext(ctx)
+	c.Assert(err, gc.IsNil)
+	<-unlocked
+}
+
+func (s *fslockSuite) TestReadWrite(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "data")
+
+	err := fslock.Write(path, strings.NewReader("hello"), 0644)
+	c.Assert(err, gc.IsNil)
+
+	content, err := fslock.Read(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(content), gc.Equals, "hello")
+}
+
+func (s *fslockSuite) TestTransform(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "data")
+	err := fslock.Write(path, strings.NewReader("1"), 0644)
+	c.Assert(err, gc.IsNil)
+
+	err = fslock.Transform(path, func(old []byte) ([]byte, error) {
+		c.Assert(string(old), gc.Equals, "1")
+		return []byte("2"), nil
+	})
+	c.Assert(err, gc.IsNil)
+
+	content, err := fslock.Read(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(content), gc.Equals, "2")
+}
+
+func (s *fslockSuite) TestTransformConcurrent(c *gc.C) {
+	const goroutines = 10
+	const incrementsEach = 50
+
+	dir := c.MkDir()
+	path := filepath.Join(dir, "counter")
+	err := fslock.Write(path, strings.NewReader("0"), 0644)
+	c.Assert(err, gc.IsNil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incrementsEach; j++ {
+				err := fslock.Transform(path, func(old []byte) ([]byte, error) {
+					n, err := strconv.Atoi(string(old))
+					if err != nil {
+						return nil, err
+					}
+					return []byte(strconv.Itoa(n + 1)), nil
+				})
+				c.Check(err, gc.IsNil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	content, err := fslock.Read(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(content, gc.DeepEquals, []byte(strconv.Itoa(goroutines*incrementsEach)))
+}
+
+func (s *fslockSuite) TestOpenLockedExcludesWriters(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "data")
+
+	f, err := fslock.OpenLocked(path, os.O_RDWR|os.O_CREATE, 0644)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fslock.Write(path, strings.NewReader("x"), 0644)
+	}()
+
+	select {
+	case err := <-done:
+		c.Check(err, gc.IsNil)
+		c.Fatalf("Write should have blocked while OpenLocked held the lock")
+	case <-time.After(shortWait):
+		// all good
+	}
+}
+
+func (s *fslockSuite) TestOwner(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "testing")
+	lock, err := fslock.NewWithOwner(path, fslock.OwnerInfo{Comment: "test suite"})
+	c.Assert(err, gc.IsNil)
+
+	_, err = lock.Owner()
+	c.Assert(err, gc.Equals, fslock.ErrNoOwner)
+
+	err = lock.Lock()
+	c.Assert(err, gc.IsNil)
+
+	owner, err := lock.Owner()
+	c.Assert(err, gc.IsNil)
+	c.Assert(owner.PID, gc.Equals, os.Getpid())
+	c.Assert(owner.Comment, gc.Equals, "test suite")
+
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+
+	_, err = lock.Owner()
+	c.Assert(err, gc.Equals, fslock.ErrNoOwner)
+}
+
+func (s *fslockSuite) TestLockWithTimeoutMentionsOwner(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "testing")
+	lock1, err := fslock.NewWithOwner(path, fslock.OwnerInfo{Comment: "holder"})
+	c.Assert(err, gc.IsNil)
+	lock2, err := fslock.New(path)
+	c.Assert(err, gc.IsNil)
+
+	err = lock1.Lock()
+	c.Assert(err, gc.IsNil)
+	defer lock1.Unlock()
+
+	err = lock2.LockWithTimeout(shortWait)
+	c.Assert(errors.Is(err, fslock.ErrTimeout), gc.Equals, true)
+	c.Assert(err, gc.ErrorMatches, ".*holder.*")
 }
 
 func (s *fslockSuite) TestStress(c *gc.C) {
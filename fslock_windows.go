@@ -4,6 +4,9 @@
 package fslock
 
 import (
+	"context"
+	"os"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -14,67 +17,416 @@ var (
 	procLockFileEx   = modkernel32.NewProc("LockFileEx")
 	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
 	procCreateEventW = modkernel32.NewProc("CreateEventW")
+	procCancelIoEx   = modkernel32.NewProc("CancelIoEx")
 )
 
-const lockfileExclusiveLock = 2
+const (
+	lockfileFailImmediately = 1
+	lockfileExclusiveLock   = 2
+
+	// errorLockViolation is ERROR_LOCK_VIOLATION, not exposed by the
+	// standard syscall package.
+	errorLockViolation = syscall.Errno(33)
+)
 
 // Lock implements cross-process locks using syscalls.
 // This implementation is based on LockFileEx syscall.
-type Lock syscall.Handle
+type Lock struct {
+	handle syscall.Handle
+	// mu guards against two Locks in this process that refer to the same
+	// path deadlocking or double-unlocking each other; see the package doc.
+	mu *sync.RWMutex
+	// path and comment support the owner diagnostics written by Lock; see
+	// the package doc and OwnerInfo.
+	path    string
+	comment string
+}
 
 // New returns a new lock around the given file.
 func New(filename string) (Lock, error) {
+	return NewWithOwner(filename, OwnerInfo{})
+}
+
+// NewWithOwner returns a new lock around the given file, recording
+// info.Comment alongside the process's pid, hostname and acquire time
+// every time the exclusive lock is acquired. The other fields of info are
+// ignored, since they are always recomputed at acquisition time.
+func NewWithOwner(filename string, info OwnerInfo) (Lock, error) {
+	// Open for asynchronous I/O so that we can timeout waiting for the lock.
+	// Also open shared so that other processes can open the file (but will
+	// still need to lock it). OPEN_ALWAYS, rather than CREATE_NEW, so that
+	// locking an existing file (e.g. one already written through Write)
+	// succeeds instead of failing with ERROR_FILE_EXISTS, matching the
+	// unix backend's plain O_CREAT.
+	handle, err := createOverlappedHandle(filename, syscall.GENERIC_READ|syscall.GENERIC_WRITE, syscall.OPEN_ALWAYS)
+	if err != nil {
+		return Lock{}, err
+	}
+	path := canonicalPath(filename)
+	return Lock{handle: handle, mu: inProcessMutex(path), path: path, comment: info.Comment}, nil
+}
+
+// createHandle opens filename with the given CreateFile access mask,
+// creation disposition and flags, shared so that other processes may
+// still open it.
+func createHandle(filename string, access, createmode, flagsAndAttrs uint32) (syscall.Handle, error) {
 	name, err := syscall.UTF16PtrFromString(filename)
 	if err != nil {
-		return 0, err
+		return syscall.InvalidHandle, err
 	}
+	return syscall.CreateFile(name, access,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, createmode, flagsAndAttrs, 0)
+}
 
-	// Open for asynchronous I/O so that we can timeout waiting for the lock.
-	// Also open shared so that other processes can open the file (but will
-	// still need to lock it).
-	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE,
-		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.CREATE_NEW, syscall.FILE_FLAG_OVERLAPPED, 0)
+// createOverlappedHandle opens filename with the given CreateFile access
+// mask and creation disposition, for asynchronous (FILE_FLAG_OVERLAPPED)
+// I/O. Only the Lock's own handle may be opened this way: see
+// openFileAndLock for why it can't also be used for an *os.File's data
+// I/O.
+func createOverlappedHandle(filename string, access, createmode uint32) (syscall.Handle, error) {
+	return createHandle(filename, access, createmode, syscall.FILE_FLAG_OVERLAPPED)
+}
+
+// openFileAndLock opens path for data I/O and locks the result, sharing
+// one plain (non-overlapped) handle between the two, and returns both.
+//
+// Unlike New/NewWithOwner's handle, this one is deliberately *not*
+// opened with FILE_FLAG_OVERLAPPED: os.File always issues its Read/Write
+// syscalls with a nil OVERLAPPED, which Windows only accepts on a handle
+// opened without that flag ("Programs currently expect the Fd method to
+// return a handle that uses ordinary synchronous I/O" - see golang.org/
+// issue/19098 and cmd/go/internal/lockedfile/internal/filelock, the
+// model this request is built on). LockFileEx still requires an
+// OVERLAPPED argument to carry the byte range even on a synchronous
+// handle, but on such a handle it blocks the calling goroutine and
+// returns only once the lock is held, rather than completing
+// asynchronously, so lockSync below doesn't wait on an event the way
+// Lock.lock/lockCtx do for the FILE_FLAG_OVERLAPPED handle from
+// New. That also means this path can't support LockContext's
+// CancelIoEx-based cancellation; LockedFile doesn't expose one.
+func openFileAndLock(path string, flag int, perm os.FileMode, comment string, shared bool) (*os.File, Lock, error) {
+	handle, err := createDataHandle(path, flag)
 	if err != nil {
-		return 0, err
+		return nil, Lock{}, err
 	}
-	return Lock(handle), nil
+	cpath := canonicalPath(path)
+	lock := Lock{handle: handle, mu: inProcessMutex(cpath), path: cpath, comment: comment}
+
+	flags := uint32(lockfileExclusiveLock)
+	if shared {
+		flags = 0
+		lock.mu.RLock()
+	} else {
+		lock.mu.Lock()
+	}
+	if err := lockSync(handle, flags); err != nil {
+		if shared {
+			lock.mu.RUnlock()
+		} else {
+			lock.mu.Unlock()
+		}
+		syscall.CloseHandle(handle)
+		return nil, Lock{}, err
+	}
+	if !shared {
+		writeOwnerInfo(lock.path, lock.comment)
+	}
+	return os.NewFile(uintptr(handle), path), lock, nil
+}
+
+// createDataHandle opens path for data I/O with exactly the caller's
+// requested access, creating it only if it doesn't already exist, to
+// match the unix/plan9 backends: a plain Read() of an existing
+// read-only file should only ever need GENERIC_READ, not the
+// GENERIC_WRITE that creating a file requires.
+func createDataHandle(path string, flag int) (syscall.Handle, error) {
+	access, createmode := winAccessAndCreateMode(flag)
+	handle, err := createHandle(path, access, createmode, syscall.FILE_ATTRIBUTE_NORMAL)
+	if err == nil || flag&os.O_CREATE != 0 || err != syscall.ERROR_FILE_NOT_FOUND {
+		return handle, err
+	}
+	// The caller didn't ask to create the file, but match New's
+	// historical behavior of always creating the lock file: retry with
+	// the write access creation needs.
+	return createHandle(path, access|syscall.GENERIC_WRITE, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL)
+}
+
+// lockSync issues a LockFileEx call with the given flags on a
+// synchronous (non-FILE_FLAG_OVERLAPPED) handle, for the whole byte
+// locked elsewhere in this file ([0,1)). Unlike Lock.lock, it does not
+// wait on the OVERLAPPED's completion event: LockFileEx blocks in the
+// kernel until the lock is acquired when called this way, and the
+// OVERLAPPED argument exists only to carry the byte range.
+func lockSync(handle syscall.Handle, flags uint32) error {
+	return lockFileEx(handle, flags, 0, 1, 0, new(syscall.Overlapped))
+}
+
+// winAccessAndCreateMode translates an os.OpenFile-style flag into the
+// GENERIC_* access mask and *_EXISTING/*_ALWAYS creation disposition that
+// CreateFile expects, the same translation syscall.Open does internally
+// for the non-overlapped handles os.OpenFile hands out.
+func winAccessAndCreateMode(flag int) (access, createmode uint32) {
+	switch flag & (os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		access = syscall.GENERIC_WRITE
+	case os.O_RDWR:
+		access = syscall.GENERIC_READ | syscall.GENERIC_WRITE
+	default:
+		access = syscall.GENERIC_READ
+	}
+	if flag&os.O_CREATE != 0 {
+		access |= syscall.GENERIC_WRITE
+	}
+	switch {
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		createmode = syscall.CREATE_NEW
+	case flag&(os.O_CREATE|os.O_TRUNC) == os.O_CREATE|os.O_TRUNC:
+		createmode = syscall.CREATE_ALWAYS
+	case flag&os.O_CREATE != 0:
+		createmode = syscall.OPEN_ALWAYS
+	case flag&os.O_TRUNC != 0:
+		createmode = syscall.TRUNCATE_EXISTING
+	default:
+		createmode = syscall.OPEN_EXISTING
+	}
+	return access, createmode
 }
 
 // Lock locks the lock.  This call will block until the lock is available.
 func (l Lock) Lock() error {
+	l.mu.Lock()
+	if err := l.lock(lockfileExclusiveLock, syscall.INFINITE); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	writeOwnerInfo(l.path, l.comment)
+	return nil
+}
+
+// Unlock unlocks the lock.
+func (l Lock) Unlock() error {
+	clearOwnerInfo(l.path)
+	// UnlockFileEx still requires a non-nil OVERLAPPED to carry the byte
+	// range, even though releasing a lock never itself waits for
+	// completion; see lockSync's doc for the equivalent reasoning on the
+	// locking side.
+	err := unlockFileEx(l.handle, 0, 1, 0, new(syscall.Overlapped))
+	l.mu.Unlock()
+	return err
+}
+
+// RUnlock unlocks a lock previously acquired with RLock.
+func (l Lock) RUnlock() error {
+	err := unlockFileEx(l.handle, 0, 1, 0, new(syscall.Overlapped))
+	l.mu.RUnlock()
+	return err
+}
+
+// LockWithTimeout tries to lock the lock until the timeout expires.
+func (l Lock) LockWithTimeout(timeout time.Duration) error {
+	return l.lockWithTimeout(lockfileExclusiveLock, timeout)
+}
+
+// RLock locks the lock for shared (read-only) access. This call will block
+// until the lock is available. Multiple holders of the shared lock may
+// coexist, but they exclude any holder of the exclusive lock obtained via
+// Lock.
+func (l Lock) RLock() error {
+	l.mu.RLock()
+	if err := l.lock(0, syscall.INFINITE); err != nil {
+		l.mu.RUnlock()
+		return err
+	}
+	return nil
+}
+
+// RLockWithTimeout tries to acquire the shared lock until the timeout
+// expires.
+func (l Lock) RLockWithTimeout(timeout time.Duration) error {
+	return l.lockWithTimeout(0, timeout)
+}
+
+// TryLock makes a single non-blocking attempt to acquire the exclusive
+// lock, reporting whether it succeeded.
+func (l Lock) TryLock() (bool, error) {
+	return l.tryAcquire(lockfileExclusiveLock)
+}
+
+// TryRLock makes a single non-blocking attempt to acquire the shared lock,
+// reporting whether it succeeded.
+func (l Lock) TryRLock() (bool, error) {
+	return l.tryAcquire(0)
+}
+
+// LockContext locks the lock, blocking until it is acquired or ctx is
+// cancelled or its deadline expires.
+func (l Lock) LockContext(ctx context.Context) error {
+	return l.lockContext(lockfileExclusiveLock, ctx)
+}
+
+// RLockContext acquires the shared lock, blocking until it is acquired or
+// ctx is cancelled or its deadline expires.
+func (l Lock) RLockContext(ctx context.Context) error {
+	return l.lockContext(0, ctx)
+}
+
+// lockWithTimeout first polls for the in-process mutex, then waits for the
+// OS-level lock for whatever time remains of timeout.
+func (l Lock) lockWithTimeout(flags uint32, timeout time.Duration) error {
+	start := time.Now()
+	for !l.tryMu(flags) {
+		if timeout > 0 && time.Since(start) > timeout {
+			return newTimeoutError(l.path)
+		}
+		time.Sleep(RetryDelay)
+	}
+
+	remaining := timeout
+	if timeout > 0 {
+		if remaining -= time.Since(start); remaining < 0 {
+			remaining = 0
+		}
+	}
+	if err := l.lock(flags, uint32(remaining/time.Millisecond)); err != nil {
+		l.unlockMu(flags)
+		return err
+	}
+	if flags == lockfileExclusiveLock {
+		writeOwnerInfo(l.path, l.comment)
+	}
+	return nil
+}
+
+// lockContext first polls for the in-process mutex, then waits for the
+// OS-level lock, cancelling the pending I/O via CancelIoEx if ctx is done
+// first.
+func (l Lock) lockContext(flags uint32, ctx context.Context) error {
+	for !l.tryMu(flags) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(RetryDelay):
+		}
+	}
+
+	if err := l.lockCtx(flags, ctx); err != nil {
+		l.unlockMu(flags)
+		return err
+	}
+	if flags == lockfileExclusiveLock {
+		writeOwnerInfo(l.path, l.comment)
+	}
+	return nil
+}
+
+// lockCtx issues a LockFileEx call with the given flags and waits for it
+// to complete, cancelling the pending I/O via CancelIoEx if ctx is done
+// first.
+func (l Lock) lockCtx(flags uint32, ctx context.Context) error {
 	ol, err := newOverlapped()
 	if err != nil {
 		return err
 	}
 	defer syscall.CloseHandle(ol.HEvent)
 	// this is asynchronous because we opened the file for async I/O.
-	if err := lockFileEx(syscall.Handle(l), lockfileExclusiveLock, 0, 1, 0, ol); err != nil {
+	if err := lockFileEx(l.handle, flags, 0, 1, 0, ol); err != nil {
 		return err
 	}
-	_, err = syscall.WaitForSingleObject(ol.HEvent, syscall.INFINITE)
-	return err
-}
 
-// Unlock unlocks the lock.
-func (l Lock) Unlock() error {
-	return unlockFileEx(syscall.Handle(l), 0, 1, 0, nil)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancelIoEx(l.handle, ol)
+		case <-done:
+		}
+	}()
+
+	if _, err := syscall.WaitForSingleObject(ol.HEvent, syscall.INFINITE); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	return nil
 }
 
-// LockWithTimeout tries to lock the lock until the timeout expires.
-func (l Lock) LockWithTimeout(timeout time.Duration) error {
+// lock issues a LockFileEx call with the given flags and waits up to
+// waitMillis for it to complete.
+func (l Lock) lock(flags uint32, waitMillis uint32) error {
 	ol, err := newOverlapped()
 	if err != nil {
 		return err
 	}
 	defer syscall.CloseHandle(ol.HEvent)
 	// this is asynchronous because we opened the file for async I/O.
-	if err := lockFileEx(syscall.Handle(l), lockfileExclusiveLock, 0, 1, 0, ol); err != nil {
+	if err := lockFileEx(l.handle, flags, 0, 1, 0, ol); err != nil {
 		return err
 	}
-	_, err = syscall.WaitForSingleObject(ol.HEvent, uint32(timeout.Nanoseconds()/1000))
+	_, err = syscall.WaitForSingleObject(ol.HEvent, waitMillis)
 	return err
 }
 
+// tryAcquire makes a single non-blocking attempt to take both the
+// in-process mutex and the OS-level lock for the given flags, reporting
+// whether it succeeded. If the OS-level attempt fails, the in-process
+// mutex is released again so this is safe to call repeatedly.
+func (l Lock) tryAcquire(flags uint32) (bool, error) {
+	if !l.tryMu(flags) {
+		return false, nil
+	}
+
+	ok, err := l.tryLock(flags)
+	if err != nil || !ok {
+		l.unlockMu(flags)
+		return false, err
+	}
+	if flags == lockfileExclusiveLock {
+		writeOwnerInfo(l.path, l.comment)
+	}
+	return true, nil
+}
+
+// tryLock makes a single non-blocking LockFileEx attempt with the given
+// flags, reporting whether the lock was acquired.
+func (l Lock) tryLock(flags uint32) (bool, error) {
+	ol, err := newOverlapped()
+	if err != nil {
+		return false, err
+	}
+	defer syscall.CloseHandle(ol.HEvent)
+	err = lockFileEx(l.handle, flags|lockfileFailImmediately, 0, 1, 0, ol)
+	if err != nil {
+		if errno, ok := err.(syscall.Errno); ok && errno == errorLockViolation {
+			return false, nil
+		}
+		return false, err
+	}
+	if _, err := syscall.WaitForSingleObject(ol.HEvent, syscall.INFINITE); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// tryMu makes a single non-blocking attempt to take the in-process mutex
+// side matching flags.
+func (l Lock) tryMu(flags uint32) bool {
+	if flags == lockfileExclusiveLock {
+		return l.mu.TryLock()
+	}
+	return l.mu.TryRLock()
+}
+
+// unlockMu releases the in-process mutex side matching flags.
+func (l Lock) unlockMu(flags uint32) {
+	if flags == lockfileExclusiveLock {
+		l.mu.Unlock()
+	} else {
+		l.mu.RUnlock()
+	}
+}
+
 // newOverlapped creates a structure used to track asynchronous
 // I/O requests that have been issued.
 func newOverlapped() (*syscall.Overlapped, error) {
@@ -109,6 +461,18 @@ func unlockFileEx(h syscall.Handle, reserved, locklow, lockhigh uint32, ol *sysc
 	return
 }
 
+func cancelIoEx(h syscall.Handle, ol *syscall.Overlapped) (err error) {
+	r1, _, e1 := syscall.Syscall(procCancelIoEx.Addr(), 2, uintptr(h), uintptr(unsafe.Pointer(ol)), 0)
+	if r1 == 0 {
+		if e1 != 0 {
+			err = error(e1)
+		} else {
+			err = syscall.EINVAL
+		}
+	}
+	return
+}
+
 func createEvent(sa *syscall.SecurityAttributes, manualReset bool, initialState bool, name *uint16) (handle syscall.Handle, err error) {
 	var _p0 uint32
 	if manualReset {